@@ -0,0 +1,85 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//
+// Wire types for the Docker Volume Plugin HTTP API, protocol version 1.1+
+// (https://docs.docker.com/engine/extend/plugins_volume/). These mirror the
+// JSON bodies Docker sends to and expects from a managed volume plugin.
+//
+
+package httpapi
+
+// createRequest is the body of VolumeDriver.Create.
+type createRequest struct {
+	Name string            `json:"Name"`
+	Opts map[string]string `json:"Opts"`
+}
+
+// nameRequest is the body shared by Remove, Path and Get.
+type nameRequest struct {
+	Name string `json:"Name"`
+}
+
+// mountRequest is the body of VolumeDriver.Mount. ID is a value Docker
+// generates per Mount call so that Mount/Unmount pairs from different
+// containers using the same volume can be balanced correctly.
+type mountRequest struct {
+	Name string `json:"Name"`
+	ID   string `json:"ID"`
+}
+
+// unmountRequest is the body of VolumeDriver.Unmount.
+type unmountRequest struct {
+	Name string `json:"Name"`
+	ID   string `json:"ID"`
+}
+
+// errorResponse is the common response shape: empty Err means success.
+type errorResponse struct {
+	Err string `json:"Err"`
+}
+
+// mountResponse is returned by both Mount and Path.
+type mountResponse struct {
+	Mountpoint string `json:"Mountpoint"`
+	Err        string `json:"Err"`
+}
+
+// volumeInfo describes a single volume in Get/List responses.
+type volumeInfo struct {
+	Name       string                 `json:"Name"`
+	Mountpoint string                 `json:"Mountpoint,omitempty"`
+	Status     map[string]interface{} `json:"Status,omitempty"`
+}
+
+// getResponse is the body of VolumeDriver.Get.
+type getResponse struct {
+	Volume volumeInfo `json:"Volume"`
+	Err    string     `json:"Err"`
+}
+
+// listResponse is the body of VolumeDriver.List.
+type listResponse struct {
+	Volumes []volumeInfo `json:"Volumes"`
+	Err     string       `json:"Err"`
+}
+
+// capabilitiesResponse is the body of VolumeDriver.Capabilities.
+type capabilitiesResponse struct {
+	Capabilities capability `json:"Capabilities"`
+}
+
+type capability struct {
+	Scope string `json:"Scope"`
+}
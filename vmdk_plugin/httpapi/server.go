@@ -0,0 +1,407 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+//
+// Docker managed-plugin HTTP API (protocol v1.1+) for the vmdk/photon
+// drivers, served over a Unix socket in /run/docker/plugins/ alongside the
+// existing drivers.VolumeDriver integration. This lets the plugin be
+// installed with `docker plugin install` instead of only as a legacy
+// sidecar process.
+//
+// The ID field Docker supplies in a Mount/Unmount request body is a value
+// Docker generates per mount call, not a container ID - so it can't be
+// compared against the container IDs the refcount package's Docker-events
+// reconciliation uses (see events.go). Mount instead resolves the real
+// container ID of whoever is mounting the volume and keys
+// refcount.RefCountsMap.Incr/Decr on that, remembering the mapping from
+// Docker's mount ID so the matching Unmount can release the same container.
+// This keeps one ID scheme - container ID - in use everywhere refcounts are
+// touched, so a `docker kill -9` reaches volumes mounted through this API
+// exactly like it does ones mounted through the legacy driver.
+//
+
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+	"golang.org/x/net/context"
+)
+
+const (
+	// default directory Docker looks for plugin sockets in
+	DefaultSocketDir = "/run/docker/plugins"
+
+	contentType = "application/vnd.docker.plugins.v1.1+json"
+
+	scopeLocal = "local"
+)
+
+// Driver is what the HTTP API needs beyond drivers.VolumeDriver to serve
+// Create/Remove/List - the handlers below assume the concrete driver
+// (vmdk or photon) implements both.
+type Driver interface {
+	drivers.VolumeDriver
+	CreateVolume(name string, opts map[string]string) error
+	RemoveVolume(name string) error
+	ListVolumes() (map[string]map[string]interface{}, error)
+}
+
+// Server serves the Docker volume plugin HTTP API for a single driver.
+type Server struct {
+	driver     Driver
+	refCounts  *refcount.RefCountsMap
+	driverName string
+
+	// used to resolve a Mount request's real container ID and to look up a
+	// container's mount destination for copy-on-first-mount (see
+	// copyonmount.go); nil if the Docker socket couldn't be reached at
+	// startup, in which case Mount fails and that feature is skipped.
+	dockerClient *client.Client
+
+	mtx sync.Mutex
+	// maps the ID Docker generated for an in-flight mount to the container
+	// ID resolveContainerID found for it, so the matching Unmount releases
+	// the same container that was Incr'd on Mount.
+	mountIDs map[string]string
+}
+
+// NewServer creates a Server for driver, wiring Mount/Unmount through
+// refCounts so discovery and the events-based reconciliation in the
+// refcount package see the same state regardless of which API a client
+// used to mount the volume.
+func NewServer(driver Driver, refCounts *refcount.RefCountsMap, driverName string) *Server {
+	c, err := client.NewClient(refcount.DockerUSocket, refcount.ApiVersion, nil, nil)
+	if err != nil {
+		log.Warningf("httpapi: failed to create Docker client (%v), Mount requests will fail", err)
+		c = nil
+	}
+
+	return &Server{
+		driver:       driver,
+		refCounts:    refCounts,
+		driverName:   driverName,
+		dockerClient: c,
+		mountIDs:     make(map[string]string),
+	}
+}
+
+// ListenAndServe opens the driver's Unix socket under socketDir and serves
+// the plugin protocol on it until the listener errors out.
+func (s *Server) ListenAndServe(socketDir string) error {
+	if err := os.MkdirAll(socketDir, 0755); err != nil {
+		return err
+	}
+
+	sockPath := filepath.Join(socketDir, s.driverName+".sock")
+	os.Remove(sockPath)
+
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", s.activate)
+	mux.HandleFunc("/VolumeDriver.Create", s.create)
+	mux.HandleFunc("/VolumeDriver.Remove", s.remove)
+	mux.HandleFunc("/VolumeDriver.Path", s.path)
+	mux.HandleFunc("/VolumeDriver.Mount", s.mount)
+	mux.HandleFunc("/VolumeDriver.Unmount", s.unmount)
+	mux.HandleFunc("/VolumeDriver.Get", s.get)
+	mux.HandleFunc("/VolumeDriver.List", s.list)
+	mux.HandleFunc("/VolumeDriver.Capabilities", s.capabilities)
+
+	log.Infof("httpapi: serving Docker volume plugin protocol for %s on %s", s.driverName, sockPath)
+	return http.Serve(l, mux)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		log.Errorf("httpapi: failed to decode request body (%v)", err)
+		reply(w, errorResponse{Err: err.Error()})
+		return false
+	}
+	return true
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("httpapi: failed to encode response (%v)", err)
+	}
+}
+
+func (s *Server) activate(w http.ResponseWriter, r *http.Request) {
+	reply(w, struct {
+		Implements []string `json:"Implements"`
+	}{Implements: []string{"VolumeDriver"}})
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if err := s.driver.CreateVolume(req.Name, req.Opts); err != nil {
+		reply(w, errorResponse{Err: err.Error()})
+		return
+	}
+	reply(w, errorResponse{})
+}
+
+func (s *Server) remove(w http.ResponseWriter, r *http.Request) {
+	var req nameRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if err := s.driver.RemoveVolume(req.Name); err != nil {
+		reply(w, errorResponse{Err: err.Error()})
+		return
+	}
+	reply(w, errorResponse{})
+}
+
+func (s *Server) path(w http.ResponseWriter, r *http.Request) {
+	var req nameRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	status, err := s.driver.GetVolume(req.Name)
+	if err != nil {
+		reply(w, mountResponse{Err: err.Error()})
+		return
+	}
+	reply(w, mountResponse{Mountpoint: mountpointOf(status)})
+}
+
+// resolveContainerID finds the real container ID of whoever is mounting
+// volName right now. Docker's Mount request only carries a per-mount ID, not
+// a container ID, so this looks at which container currently lists volName
+// among its mounts - the same thing discoverAndSync does for crash recovery.
+//
+// Containers already tracked as holders of volName are skipped: when volName
+// is mounted concurrently by more than one container, every one of them
+// lists it in Mounts, so picking an arbitrary match could resolve this Mount
+// back to a container that already holds the volume, making Incr a no-op and
+// leaving this Mount's eventual Unmount to release the wrong holder.
+//
+// Any other container whose Mounts list volName matches, whether or not it is
+// running; the first such container ContainerList returns is used.
+func (s *Server) resolveContainerID(volName string) (string, error) {
+	if s.dockerClient == nil {
+		return "", fmt.Errorf("no Docker client available to resolve a container for volume %s", volName)
+	}
+
+	held := make(map[string]struct{})
+	for _, id := range s.refCounts.GetUsers(volName) {
+		held[id] = struct{}{}
+	}
+
+	containers, err := s.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	if err != nil {
+		return "", err
+	}
+
+	for _, ct := range containers {
+		if _, already := held[ct.ID]; already {
+			continue
+		}
+		info, err := s.dockerClient.ContainerInspect(context.Background(), ct.ID)
+		if err != nil {
+			continue
+		}
+		for _, m := range info.Mounts {
+			if m.Name == volName {
+				return ct.ID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no new container found mounting volume %s", volName)
+}
+
+// forgetMountID removes id's recorded container from mountIDs. Used on every
+// Mount failure path: Docker never sends an Unmount for a Mount it saw fail,
+// so leaving the entry behind would leak it forever.
+func (s *Server) forgetMountID(id string) {
+	s.mtx.Lock()
+	delete(s.mountIDs, id)
+	s.mtx.Unlock()
+}
+
+// mount handles VolumeDriver.Mount. The refcount for req.Name is keyed on
+// the container ID resolveContainerID finds for req.ID, not req.ID itself,
+// so that the events-based reconciliation in the refcount package (which
+// only ever sees real container IDs) can release it too.
+func (s *Server) mount(w http.ResponseWriter, r *http.Request) {
+	var req mountRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	containerID, err := s.resolveContainerID(req.Name)
+	if err != nil {
+		log.Errorf("httpapi: mount: %v", err)
+		reply(w, mountResponse{Err: err.Error()})
+		return
+	}
+	s.mtx.Lock()
+	s.mountIDs[req.ID] = containerID
+	s.mtx.Unlock()
+
+	if count := s.refCounts.Incr(req.Name, containerID); count > 1 {
+		// Already mounted for some other container - report the existing mountpoint.
+		status, err := s.driver.GetVolume(req.Name)
+		if err != nil {
+			s.refCounts.Decr(req.Name, containerID)
+			s.forgetMountID(req.ID)
+			reply(w, mountResponse{Err: err.Error()})
+			return
+		}
+		reply(w, mountResponse{Mountpoint: mountpointOf(status)})
+		return
+	}
+
+	status, err := s.driver.GetVolume(req.Name)
+	if err != nil {
+		s.refCounts.Decr(req.Name, containerID)
+		s.forgetMountID(req.ID)
+		reply(w, mountResponse{Err: err.Error()})
+		return
+	}
+
+	// Mirror syncMountsWithRefCounters' recovery-mount handling: honor the
+	// volume's read-only access mode, and only photon volumes need their
+	// disk ID threaded through as the id param.
+	id := ""
+	if s.driverName == refcount.PhotonDriver {
+		if diskID, ok := status["ID"].(string); ok {
+			id = diskID
+		} else {
+			log.Warning("httpapi: mount: failed to get disk ID for photon disk, cannot mount in-use disk")
+		}
+	}
+	isReadOnly := false
+	if access, ok := status["access"]; ok && access == "read-only" {
+		isReadOnly = true
+	}
+
+	fstype, _ := status["fstype"].(string)
+	mountpoint, err := s.driver.MountVolume(req.Name, fstype, id, isReadOnly, false)
+	if err != nil {
+		s.refCounts.Decr(req.Name, containerID)
+		s.forgetMountID(req.ID)
+		reply(w, mountResponse{Err: err.Error()})
+		return
+	}
+
+	// This is the volume's first mount (count just went 0 -> 1): give it a
+	// chance to be seeded from the image, same as Docker's own `local`
+	// driver would for a fresh named volume.
+	if s.dockerClient != nil {
+		refcount.CopyImageContentIfEmpty(s.dockerClient, status, req.Name, containerID, mountpoint)
+	}
+
+	reply(w, mountResponse{Mountpoint: mountpoint})
+}
+
+// unmount handles VolumeDriver.Unmount, releasing the container ID that was
+// resolved for req.ID at Mount time, and only asking the driver to actually
+// unmount once no container is left holding the volume.
+func (s *Server) unmount(w http.ResponseWriter, r *http.Request) {
+	var req unmountRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	s.mtx.Lock()
+	containerID, ok := s.mountIDs[req.ID]
+	delete(s.mountIDs, req.ID)
+	s.mtx.Unlock()
+	if !ok {
+		reply(w, errorResponse{Err: fmt.Sprintf("unmount: unknown mount ID %s for volume %s", req.ID, req.Name)})
+		return
+	}
+
+	count, err := s.refCounts.Decr(req.Name, containerID)
+	if err != nil {
+		reply(w, errorResponse{Err: err.Error()})
+		return
+	}
+
+	if count == 0 {
+		if err := s.driver.UnmountVolume(req.Name); err != nil {
+			reply(w, errorResponse{Err: err.Error()})
+			return
+		}
+	}
+	reply(w, errorResponse{})
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	var req nameRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	status, err := s.driver.GetVolume(req.Name)
+	if err != nil {
+		reply(w, getResponse{Err: err.Error()})
+		return
+	}
+	reply(w, getResponse{Volume: volumeInfo{
+		Name:       req.Name,
+		Mountpoint: mountpointOf(status),
+		Status:     status,
+	}})
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	volumes, err := s.driver.ListVolumes()
+	if err != nil {
+		reply(w, listResponse{Err: err.Error()})
+		return
+	}
+
+	infos := make([]volumeInfo, 0, len(volumes))
+	for name, status := range volumes {
+		infos = append(infos, volumeInfo{Name: name, Mountpoint: mountpointOf(status)})
+	}
+	reply(w, listResponse{Volumes: infos})
+}
+
+func (s *Server) capabilities(w http.ResponseWriter, r *http.Request) {
+	reply(w, capabilitiesResponse{Capabilities: capability{Scope: scopeLocal}})
+}
+
+func mountpointOf(status map[string]interface{}) string {
+	mp, _ := status["mountpoint"].(string)
+	return mp
+}
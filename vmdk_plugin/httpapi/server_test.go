@@ -0,0 +1,189 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+)
+
+// fakeDriver is a minimal in-memory Driver used to exercise the HTTP
+// handlers without a real vmdk/photon backend or a Docker daemon.
+type fakeDriver struct {
+	volumes map[string]map[string]interface{}
+	mounted map[string]bool
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{
+		volumes: map[string]map[string]interface{}{
+			"vol1": {"fstype": "ext4", "mountpoint": "/mnt/vmdk/vol1"},
+		},
+		mounted: map[string]bool{},
+	}
+}
+
+func (f *fakeDriver) CreateVolume(name string, opts map[string]string) error {
+	f.volumes[name] = map[string]interface{}{"fstype": "ext4", "mountpoint": "/mnt/vmdk/" + name}
+	return nil
+}
+
+func (f *fakeDriver) RemoveVolume(name string) error {
+	delete(f.volumes, name)
+	return nil
+}
+
+func (f *fakeDriver) ListVolumes() (map[string]map[string]interface{}, error) {
+	return f.volumes, nil
+}
+
+func (f *fakeDriver) GetVolume(name string) (map[string]interface{}, error) {
+	status, ok := f.volumes[name]
+	if !ok {
+		return nil, fmt.Errorf("no such volume %s", name)
+	}
+	return status, nil
+}
+
+func (f *fakeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, exists bool) (string, error) {
+	f.mounted[name] = true
+	return f.volumes[name]["mountpoint"].(string), nil
+}
+
+func (f *fakeDriver) UnmountVolume(name string) error {
+	f.mounted[name] = false
+	return nil
+}
+
+// newTestServer builds a Server whose dockerClient is nil, so Mount always
+// fails to resolve a container ID - TestMountWithoutDockerClientFails
+// exercises that path directly, and the other cases call only Unmount, Get
+// and List, so none of them require a live Docker daemon.
+func newTestServer(d *fakeDriver) *Server {
+	return &Server{
+		driver:     d,
+		refCounts:  refcount.NewRefCountsMap(),
+		driverName: "vmdk",
+		mountIDs:   make(map[string]string),
+	}
+}
+
+func TestMountWithoutDockerClientFails(t *testing.T) {
+	s := newTestServer(newFakeDriver())
+
+	buf, _ := json.Marshal(mountRequest{Name: "vol1", ID: "mount-1"})
+	req := httptest.NewRequest("POST", "/VolumeDriver.Mount", bytes.NewReader(buf))
+	w := httptest.NewRecorder()
+
+	s.mount(w, req)
+
+	var resp mountResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Err == "" {
+		t.Fatal("expected Mount to fail when no Docker client is available to resolve a container ID")
+	}
+	if len(s.mountIDs) != 0 {
+		t.Fatalf("expected no mount ID to be remembered on a failed mount, got %v", s.mountIDs)
+	}
+}
+
+func TestUnmountUnknownMountID(t *testing.T) {
+	s := newTestServer(newFakeDriver())
+
+	buf, _ := json.Marshal(unmountRequest{Name: "vol1", ID: "never-mounted"})
+	req := httptest.NewRequest("POST", "/VolumeDriver.Unmount", bytes.NewReader(buf))
+	w := httptest.NewRecorder()
+
+	s.unmount(w, req)
+
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Err == "" {
+		t.Fatal("expected Unmount to fail for a mount ID it never saw from Mount")
+	}
+}
+
+func TestUnmountReleasesTheResolvedContainer(t *testing.T) {
+	s := newTestServer(newFakeDriver())
+
+	// Simulate what mount() would have recorded had resolveContainerID
+	// succeeded, so unmount() can be tested independently of a Docker client.
+	s.mountIDs["mount-1"] = "containerA"
+	s.refCounts.Incr("vol1", "containerA")
+
+	buf, _ := json.Marshal(unmountRequest{Name: "vol1", ID: "mount-1"})
+	req := httptest.NewRequest("POST", "/VolumeDriver.Unmount", bytes.NewReader(buf))
+	w := httptest.NewRecorder()
+
+	s.unmount(w, req)
+
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Err != "" {
+		t.Fatalf("unexpected error: %s", resp.Err)
+	}
+	if users := s.refCounts.GetUsers("vol1"); len(users) != 0 {
+		t.Fatalf("expected vol1 to have no users left, got %v", users)
+	}
+	if _, stillTracked := s.mountIDs["mount-1"]; stillTracked {
+		t.Fatal("expected the mount ID to be forgotten after Unmount")
+	}
+}
+
+func TestGetAndList(t *testing.T) {
+	d := newFakeDriver()
+	s := newTestServer(d)
+
+	getBuf, _ := json.Marshal(nameRequest{Name: "vol1"})
+	getReq := httptest.NewRequest("POST", "/VolumeDriver.Get", bytes.NewReader(getBuf))
+	getW := httptest.NewRecorder()
+	s.get(getW, getReq)
+
+	var getResp getResponse
+	if err := json.Unmarshal(getW.Body.Bytes(), &getResp); err != nil {
+		t.Fatalf("failed to decode Get response: %v", err)
+	}
+	if getResp.Err != "" {
+		t.Fatalf("unexpected error: %s", getResp.Err)
+	}
+	if getResp.Volume.Mountpoint != "/mnt/vmdk/vol1" {
+		t.Fatalf("got mountpoint=%s, want /mnt/vmdk/vol1", getResp.Volume.Mountpoint)
+	}
+
+	listReq := httptest.NewRequest("POST", "/VolumeDriver.List", nil)
+	listW := httptest.NewRecorder()
+	s.list(listW, listReq)
+
+	var listResp listResponse
+	if err := json.Unmarshal(listW.Body.Bytes(), &listResp); err != nil {
+		t.Fatalf("failed to decode List response: %v", err)
+	}
+	if len(listResp.Volumes) != 1 || listResp.Volumes[0].Name != "vol1" {
+		t.Fatalf("got volumes=%v, want a single vol1 entry", listResp.Volumes)
+	}
+}
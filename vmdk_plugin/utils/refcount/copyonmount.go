@@ -0,0 +1,154 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+//
+// "Copy image contents on first mount" for named volumes.
+//
+// Docker's built-in `local` driver seeds a fresh named volume with
+// whatever files already exist at the mount destination in the image, so a
+// container doesn't silently lose that content the first time the volume
+// is attached. vmdk volumes don't get this for free since the copy has to
+// happen on our side of the plugin boundary. CopyImageContentIfEmpty
+// reproduces it for volumes created with the copyOnFirstMount=true option,
+// called whenever a volume transitions from unmounted to mounted.
+//
+
+package refcount
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+)
+
+// CopyOnFirstMountOpt is the per-volume create option (`docker volume
+// create -o copyOnFirstMount=true ...`) that enables this behavior. It is
+// off by default so existing volumes keep their current semantics.
+const CopyOnFirstMountOpt = "copyOnFirstMount"
+
+// CopyImageContentIfEmpty copies whatever containerID has at its mount
+// destination for volName into mountpoint, but only if status opted into
+// CopyOnFirstMountOpt and mountpoint is still empty - i.e. this really is
+// the volume's first use, not a re-mount of a volume that already has data.
+func CopyImageContentIfEmpty(c *client.Client, status map[string]interface{}, volName string, containerID string, mountpoint string) {
+	if enabled, _ := status[CopyOnFirstMountOpt].(string); enabled != "true" {
+		return
+	}
+
+	empty, err := dirIsEmpty(mountpoint)
+	if err != nil {
+		log.Errorf("CopyImageContentIfEmpty: failed to inspect %s (%v)", mountpoint, err)
+		return
+	}
+	if !empty {
+		return
+	}
+
+	dest, rootfs, err := destinationAndRootfs(c, volName, containerID)
+	if err != nil {
+		log.Errorf("CopyImageContentIfEmpty: failed to inspect container %s (%v)", containerID, err)
+		return
+	}
+	if dest == "" {
+		log.Debugf("CopyImageContentIfEmpty: container %s has no destination for volume %s, nothing to copy", containerID, volName)
+		return
+	}
+	if rootfs == "" {
+		log.Warningf("CopyImageContentIfEmpty: no accessible rootfs for container %s, skipping seed of volume=%s", containerID, volName)
+		return
+	}
+
+	src := filepath.Join(rootfs, dest)
+	log.Infof("CopyImageContentIfEmpty: seeding volume=%s from %s", volName, src)
+	if err := copyTree(src, mountpoint); err != nil {
+		log.Errorf("CopyImageContentIfEmpty: copy failed for volume=%s (%v)", volName, err)
+	}
+}
+
+// destinationAndRootfs looks up, from containerID's own Mounts list, the
+// destination path volName is mounted at, and a path from which that
+// container's root filesystem can be read.
+//
+// Docker issues Mount before starting the container's process, so
+// State.Pid (and therefore /proc/<pid>/root) may still be 0 at this point -
+// falling back to it would silently skip every first mount. A created
+// container's filesystem is laid out by the graph driver before the process
+// exists, though, so GraphDriver.Data["MergedDir"] is used instead whenever
+// it's available, and /proc/<pid>/root is only a fallback for graph drivers
+// that don't report one.
+func destinationAndRootfs(c *client.Client, volName string, containerID string) (string, string, error) {
+	info, err := c.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return "", "", err
+	}
+
+	dest := ""
+	for _, m := range info.Mounts {
+		if m.Name == volName {
+			dest = m.Destination
+			break
+		}
+	}
+	if dest == "" {
+		return "", "", nil
+	}
+
+	if merged := info.GraphDriver.Data["MergedDir"]; merged != "" {
+		return dest, merged, nil
+	}
+	if info.State != nil && info.State.Pid > 0 {
+		return dest, filepath.Join("/proc", strconv.Itoa(info.State.Pid), "root"), nil
+	}
+	return dest, "", nil
+}
+
+// dirIsEmpty reports whether dir exists and has no entries.
+func dirIsEmpty(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	switch err {
+	case nil:
+		return false, nil
+	case io.EOF:
+		return true, nil
+	default:
+		return false, err
+	}
+}
+
+// copyTree copies src's contents into dst. `cp -a` is used instead of a
+// hand-rolled recursive copy so symlinks, devices and sparse files behave
+// exactly like they do for Docker's own image-to-volume copy.
+func copyTree(src, dst string) error {
+	if _, err := os.Stat(src); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return exec.Command("cp", "-a", src+"/.", dst).Run()
+}
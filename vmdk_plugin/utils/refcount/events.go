@@ -0,0 +1,182 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+//
+// Continuous refcount reconciliation via the Docker events stream.
+//
+// Mount/Unmount callbacks and the one-shot startup discovery in refcnt.go
+// only catch a container going away cleanly. A `docker kill -9` never
+// reaches the plugin as an Unmount, so without this the refcount for that
+// container's volumes would stay stuck until the next restart. This file
+// subscribes to dockerd's event stream and keeps refcounts converged with
+// it for as long as the plugin runs.
+//
+
+package refcount
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers"
+	"golang.org/x/net/context"
+)
+
+const (
+	// container lifecycle events that can change refcounts
+	eventStart   = "start"
+	eventDie     = "die"
+	eventDestroy = "destroy"
+	eventUnpause = "unpause"
+
+	minEventsBackoff = 1 * time.Second
+	maxEventsBackoff = 30 * time.Second
+
+	// how long a connection has to stay up before we consider dockerd
+	// healthy again and reset the reconnect backoff
+	healthyStreamDuration = 1 * time.Minute
+)
+
+// watchDockerEvents subscribes to the Docker container events stream and
+// adjusts refcounts as containers start, die, are destroyed or unpaused. It
+// reconnects with backoff if the stream drops (e.g. dockerd
+// restarting), and runs a single discoverAndSync pass on every reconnect to
+// catch anything that happened while disconnected. The backoff resets once a
+// connection stays up for healthyStreamDuration, so a blip early in the
+// plugin's life doesn't leave every later reconnect pinned at
+// maxEventsBackoff.
+func (r *RefCountsMap) watchDockerEvents(d drivers.VolumeDriver) {
+	backoff := minEventsBackoff
+	firstAttempt := true
+
+	for {
+		c, err := client.NewClient(DockerUSocket, ApiVersion, nil, defaultHeaders)
+		if err != nil {
+			log.Errorf("watchDockerEvents: failed to create Docker client (%v), retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		if !firstAttempt {
+			// We may have missed events while disconnected - resync once
+			// before trusting the event stream again.
+			log.Info("watchDockerEvents: reconnected, running a sync pass to catch up")
+			if err := r.discoverAndSync(c, d); err != nil {
+				log.Errorf("watchDockerEvents: catch-up sync failed (%v)", err)
+			}
+		}
+
+		connectedAt := time.Now()
+		err = r.streamEvents(c, d)
+		if time.Since(connectedAt) >= healthyStreamDuration {
+			// The stream stayed up long enough that whatever caused the
+			// previous failure(s) is presumably gone - stop treating dockerd
+			// as flaky and go back to reconnecting quickly.
+			backoff = minEventsBackoff
+		} else {
+			backoff = nextBackoff(backoff)
+		}
+		log.Warningf("watchDockerEvents: event stream ended (%v), reconnecting in %v", err, backoff)
+		firstAttempt = false
+		time.Sleep(backoff)
+	}
+}
+
+// nextBackoff doubles the backoff delay up to maxEventsBackoff.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxEventsBackoff {
+		d = maxEventsBackoff
+	}
+	return d
+}
+
+// streamEvents reads the Docker container events stream until it errors out
+// or is closed. How long it stayed connected is used by watchDockerEvents to
+// decide whether to reset its reconnect backoff.
+func (r *RefCountsMap) streamEvents(c *client.Client, d drivers.VolumeDriver) error {
+	f := filters.NewArgs()
+	f.Add("type", "container")
+
+	body, err := c.Events(context.Background(), types.EventsOptions{Filters: f})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var msg types.Message
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		r.handleContainerEvent(c, d, msg)
+	}
+}
+
+// handleContainerEvent reacts to a single container lifecycle event by
+// re-inspecting the container (when it still exists) and adjusting
+// refcounts accordingly.
+func (r *RefCountsMap) handleContainerEvent(c *client.Client, d drivers.VolumeDriver, msg types.Message) {
+	action := string(msg.Action)
+	containerID := msg.Actor.ID
+	if containerID == "" {
+		containerID = msg.ID
+	}
+
+	switch action {
+	case eventStart, eventUnpause:
+		r.seedFromContainer(c, containerID)
+
+	case eventDie, eventDestroy:
+		// Deliberately not eventKill: `docker kill --signal=...` fires a
+		// kill event without the container actually stopping, and
+		// releasing its volumes here would recovery-unmount them out from
+		// under a container that is still running. die/destroy only fire
+		// once the container has actually exited.
+		log.Debugf("watchDockerEvents: container %s %s, releasing its volumes", containerID, action)
+		r.releaseContainer(containerID)
+	}
+}
+
+// releaseContainer forgets containerID as a user of every volume it was
+// holding. Used for die/destroy, where the container may already be gone
+// and ContainerInspect can no longer tell us which volumes it had.
+func (r *RefCountsMap) releaseContainer(containerID string) {
+	r.mtx.Lock()
+	held := []string{}
+	for vol, rc := range r.refMap {
+		if _, ok := rc.containers[containerID]; ok {
+			held = append(held, vol)
+		}
+	}
+	r.mtx.Unlock()
+
+	for _, vol := range held {
+		if _, err := r.Decr(vol, containerID); err != nil {
+			log.Warningf("releaseContainer: failed to release volume=%s container=%s (%v)", vol, containerID, err)
+		}
+	}
+}
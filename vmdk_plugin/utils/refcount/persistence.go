@@ -0,0 +1,227 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+//
+// Persistent (BoltDB-backed) storage for refcounts.
+//
+// RefCountsMap.Init used to be able to rebuild refcounts only by asking
+// Docker, which meant the plugin had to come up after dockerd and had no
+// memory of its own state across a restart. This file adds a small BoltDB
+// database that Incr/Decr keep up to date transactionally, so Init can load
+// authoritative counts straight from disk and only has to fall back to
+// Docker discovery (see discoverFromDocker in refcnt.go) when the database
+// is missing or disagrees with /proc/mounts.
+//
+
+package refcount
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// default location of the refcount database on the ESX/Linux VM
+	defaultDbPath = "/var/lib/vdvs/refcount.db"
+
+	// bucket holding one key (volume name) -> persistedRefCount per volume
+	refcountBucket = "refcounts"
+
+	dbFileMode    = 0600
+	dbOpenTimeout = 1 * time.Second
+)
+
+// refCountDb is a thin wrapper around a BoltDB handle.
+type refCountDb struct {
+	bolt *bolt.DB
+}
+
+// persistedRefCount is the on-disk representation of a refCount. Only the
+// fields that need to survive a restart are kept here - "mounted" and "dev"
+// are always re-derived from /proc/mounts by getMountInfo.
+type persistedRefCount struct {
+	ContainerIDs []string `json:"containerIds"`
+}
+
+// openRefCountDb opens (creating if needed) the BoltDB file at path and
+// makes sure the refcounts bucket exists.
+func openRefCountDb(path string) (*refCountDb, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, dbFileMode, &bolt.Options{Timeout: dbOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(refcountBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &refCountDb{bolt: db}, nil
+}
+
+// restoreFromDb loads all persisted refcounts into r.refMap and checks the
+// result against /proc/mounts. It returns true if the DB was usable and
+// consistent, in which case r.refMap is now authoritative and Init does not
+// need to fall back to Docker discovery.
+func (r *RefCountsMap) restoreFromDb() bool {
+	if r.db == nil {
+		return false
+	}
+
+	r.mtx.Lock()
+	err := r.db.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(refcountBucket))
+		return b.ForEach(func(k, v []byte) error {
+			var p persistedRefCount
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			rc := newRefCount()
+			for _, id := range p.ContainerIDs {
+				rc.containers[id] = struct{}{}
+			}
+			r.refMap[string(k)] = rc
+			return nil
+		})
+	})
+	r.mtx.Unlock()
+
+	if err != nil {
+		log.Errorf("Failed to read refcount DB (%v)", err)
+		r.purgeRefMap()
+		return false
+	}
+
+	if len(r.refMap) == 0 {
+		// An empty, freshly-created DB looks just like a missing one - there
+		// is nothing here worth trusting, so let Docker discovery populate it.
+		return false
+	}
+
+	if err := r.getMountInfo(); err != nil {
+		r.purgeRefMap()
+		return false
+	}
+
+	if !r.consistentWithMounts() {
+		// The DB disagrees with /proc/mounts - nothing we loaded can be
+		// trusted, so start the same way Init would with no DB at all
+		// rather than leaving Docker discovery to build on top of stale
+		// entries.
+		r.purgeRefMap()
+		return false
+	}
+
+	return true
+}
+
+// purgeRefMap empties refMap. Called whenever a restore attempt turns out
+// not to be trustworthy, so callers always see either a fully restored map
+// or a genuinely empty one - never a partial or stale one left behind.
+func (r *RefCountsMap) purgeRefMap() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for vol := range r.refMap {
+		delete(r.refMap, vol)
+	}
+}
+
+// consistentWithMounts checks that what was loaded from the DB agrees with
+// /proc/mounts (already folded into r.refMap by getMountInfo): every volume
+// we believe is in use must actually be mounted, and vice versa. A mismatch
+// means the DB is stale and Init should fall back to Docker discovery.
+func (r *RefCountsMap) consistentWithMounts() bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	for vol, rc := range r.refMap {
+		if (rc.count() > 0) != rc.mounted {
+			log.Warningf("Refcount DB disagrees with /proc/mounts for volume %s (count=%d mounted=%t)",
+				vol, rc.count(), rc.mounted)
+			return false
+		}
+	}
+	return true
+}
+
+// persist writes the current set of container IDs for vol to the DB in its
+// own transaction. Safe to call with r.mtx already held by the caller.
+func (r *RefCountsMap) persist(vol string, rc *refCount) {
+	if r.db == nil {
+		return
+	}
+
+	ids := make([]string, 0, len(rc.containers))
+	for id := range rc.containers {
+		ids = append(ids, id)
+	}
+
+	buf, err := json.Marshal(persistedRefCount{ContainerIDs: ids})
+	if err != nil {
+		log.Errorf("Failed to marshal refcount for %s (%v)", vol, err)
+		return
+	}
+
+	err = r.db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(refcountBucket))
+		return b.Put([]byte(vol), buf)
+	})
+	if err != nil {
+		log.Errorf("Failed to persist refcount for %s (%v)", vol, err)
+	}
+}
+
+// forget removes vol from the DB entirely, e.g. once its refcount drops to 0.
+func (r *RefCountsMap) forget(vol string) {
+	if r.db == nil {
+		return
+	}
+
+	err := r.db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(refcountBucket))
+		return b.Delete([]byte(vol))
+	})
+	if err != nil {
+		log.Errorf("Failed to remove refcount for %s from DB (%v)", vol, err)
+	}
+}
+
+// persistAll writes every entry currently in r.refMap to the DB. Used after
+// Docker discovery rebuilds the map from scratch, so the DB reflects it.
+func (r *RefCountsMap) persistAll() {
+	if r.db == nil {
+		return
+	}
+
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for vol, rc := range r.refMap {
+		r.persist(vol, rc)
+	}
+}
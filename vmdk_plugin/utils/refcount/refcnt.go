@@ -45,8 +45,11 @@
 //
 // After refcount discovery, results are compared to /proc/mounts content.
 //
-// We rely on all plugin mounts being in /mnt/vmdk/<volume_name>, and will
-// unount stuff there at will - this place SHOULD NOT be used for manual mounts.
+// Mounts are identified by the directory they live under rather than a
+// single hardcoded /mnt/vmdk: Init is given the (driver name, mount root)
+// pairs to track, and getMountInfo attributes each /proc/mounts entry to
+// whichever registered root it falls under. We will unmount stuff under a
+// registered root at will - these places SHOULD NOT be used for manual mounts.
 //
 // If a volume IS mounted, but should not be (refcount = 0)
 //   - we assume there was a restart of VM or even ESX, and
@@ -68,6 +71,19 @@
 // The serialization of operations per volume is assured by the volume/store
 // of the docker daemon.
 //
+// Refcounts are also persisted to a local BoltDB (see persistence.go) so
+// that a plugin restart does not have to depend on Docker being reachable:
+// Init first tries to restore authoritative counts from the DB and only
+// falls back to the Docker discovery described above when the DB is absent
+// or disagrees with /proc/mounts.
+//
+// A volume's refcount is the set of container IDs currently holding it
+// mounted, not a bare integer: this makes a double-mount from the same
+// container a no-op instead of an over-count, and lets discovery recover
+// deterministically from Docker's live-restore feature, where dockerd comes
+// back up without restarting containers and so never re-issues their
+// Mount calls.
+//
 
 package refcount
 
@@ -94,13 +110,31 @@ const (
 
 	// consts for finding and parsing linux mount information
 	linuxMountsFile = "/proc/mounts"
-	photonDriver    = "photon"
+
+	// PhotonDriver is the Driver field value Docker reports for photon
+	// volumes. Exported so callers outside this package (e.g. httpapi) can
+	// apply the same photon-specific disk ID handling that recovery mounts
+	// do here.
+	PhotonDriver = "photon"
 )
 
+// DriverRoot pairs a driver's name (the value Docker reports in a mount's
+// Driver field, e.g. "vmdk" or "photon") with the directory its volumes are
+// mounted under. Registering one per driver with Init lets getMountInfo
+// tell several drivers' volumes apart in the same /proc/mounts scan instead
+// of assuming a single global mount root.
+type DriverRoot struct {
+	Name      string
+	MountRoot string
+}
+
 // info about individual volume ref counts and mount
 type refCount struct {
-	// refcount for the given volume.
-	count uint
+	// IDs of the containers currently holding this volume mounted. Tracking
+	// IDs rather than a bare counter makes Mount/Unmount idempotent for a
+	// given container (a double-mount is a no-op, not a double Incr) and
+	// lets discovery reconcile stale or missed IDs individually.
+	containers map[string]struct{}
 
 	// Is the volume mounted from OS point of view
 	// (i.e. entry in /proc/mounts exists)
@@ -109,24 +143,39 @@ type refCount struct {
 	// Volume is mounted from this device. Used on recovery only , for info
 	// purposes. Value is empty during normal operation
 	dev string
+
+	// Name of the driver that owns this volume, as attributed by
+	// getMountInfo matching the mount's directory against a registered
+	// DriverRoot, or by seedFromContainer from the Driver field Docker
+	// reports for the mount. Empty until one of those has seen the volume.
+	driver string
+}
+
+// count returns the number of containers currently holding the volume.
+func (rc *refCount) count() uint {
+	return uint(len(rc.containers))
+}
+
+// anyContainer returns one of rc's holding container IDs, arbitrarily -
+// used where any container's view of the volume's destination path will do.
+func anyContainer(rc *refCount) (string, bool) {
+	for id := range rc.containers {
+		return id, true
+	}
+	return "", false
 }
 
 // RefCountsMap struct
 type RefCountsMap struct {
 	refMap map[string]*refCount // Map of refCounts
 	mtx    *sync.RWMutex        // Synchronizes RefCountsMap ops
+	db     *refCountDb          // Persistent (BoltDB-backed) copy of refMap, may be nil
+	roots  []DriverRoot         // driver name -> mount root pairs registered with Init
 }
 
 var (
-	// vmdk or local. We use "vmdk" only in production, but need "local" to
-	// allow no-ESX test. sanity_test.go '-d' flag allows to switch it to local
-	driverName string
-
 	// header for Docker Remote API
 	defaultHeaders map[string]string
-
-	// root dir for mounted volumes
-	mountRoot string
 )
 
 // local init() for initializing stuff in before running any code in this file
@@ -145,17 +194,45 @@ func NewRefCountsMap() *RefCountsMap {
 // Creates a new refCount
 func newRefCount() *refCount {
 	return &refCount{
-		count: 0,
+		containers: make(map[string]struct{}),
 	}
 }
 
-// Init Refcounts. Discover volume usage refcounts from Docker.
+// Init Refcounts. Restores refcounts from the persistent DB if possible,
+// and only goes through Docker discovery if the DB is missing or if what
+// it holds doesn't agree with the mounts we actually see in /proc/mounts.
+// roots registers the (driver name, mount root) pairs whose volumes this
+// RefCountsMap should track - typically one, but more than one driver (e.g.
+// vmdk and photon) can share a RefCountsMap and run in the same process.
 // This functions does not sync with mount/unmount handlers and should be called
 // and completed BEFORE we start accepting Mount/unmount requests.
-func (r RefCountsMap) Init(d drivers.VolumeDriver, mountDir string, name string) {
+func (r *RefCountsMap) Init(d drivers.VolumeDriver, roots ...DriverRoot) {
+	r.roots = roots
+
+	db, err := openRefCountDb(defaultDbPath)
+	if err != nil {
+		log.Errorf("Failed to open refcount DB %s (%v), will rely on Docker discovery", defaultDbPath, err)
+	}
+	r.db = db
+
+	if r.restoreFromDb() {
+		log.Infof("Restored %d volume refcounts from %s", len(r.refMap), defaultDbPath)
+	} else {
+		log.Info("Refcount DB missing or inconsistent with /proc/mounts, falling back to Docker discovery")
+		r.discoverFromDocker(d)
+	}
+
+	// Keep refcounts converged with dockerd's view for as long as the
+	// plugin runs, instead of only reconciling once at startup.
+	go r.watchDockerEvents(d)
+}
+
+// discoverFromDocker rebuilds the refcount map from Docker's view of the
+// world, as Init used to do unconditionally before refcounts were persisted.
+func (r *RefCountsMap) discoverFromDocker(d drivers.VolumeDriver) {
 	e := os.Getenv("VDVS_DISCOVER_VOLUMES")
 	if e == "" {
-		log.Debug("RefCountsMap.Init: Skipping Docker volumes discovery - VDVS_DISCOVER_VOLUMES not set")
+		log.Debug("discoverFromDocker: Skipping Docker volumes discovery - VDVS_DISCOVER_VOLUMES not set")
 		return
 	}
 	c, err := client.NewClient(DockerUSocket, ApiVersion, nil, defaultHeaders)
@@ -163,8 +240,6 @@ func (r RefCountsMap) Init(d drivers.VolumeDriver, mountDir string, name string)
 		log.Panicf("Failed to create client for Docker at %s.( %v)",
 			DockerUSocket, err)
 	}
-	mountRoot = mountDir
-	driverName = name
 
 	log.Infof("Getting volume data from %s", DockerUSocket)
 	info, err := c.Info(context.Background())
@@ -191,26 +266,34 @@ func (r RefCountsMap) Init(d drivers.VolumeDriver, mountDir string, name string)
 	log.Infof("Discovered %d volumes in use.", len(r.refMap))
 	for name, cnt := range r.refMap {
 		log.Infof("Volume name=%s count=%d mounted=%t device='%s'",
-			name, cnt.count, cnt.mounted, cnt.dev)
+			name, cnt.count(), cnt.mounted, cnt.dev)
 	}
+	r.persistAll()
 }
 
-// Returns ref count for the volume.
-// If volume is not referred (not in the map), return 0
-func (r RefCountsMap) GetCount(vol string) uint {
+// GetUsers returns the IDs of the containers currently holding vol mounted.
+// If the volume is not referred (not in the map), returns an empty slice.
+func (r *RefCountsMap) GetUsers(vol string) []string {
 	// RLocks the RefCountsMap
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
 
 	rc := r.refMap[vol]
 	if rc == nil {
-		return 0
+		return []string{}
 	}
-	return rc.count
+	ids := make([]string, 0, len(rc.containers))
+	for id := range rc.containers {
+		ids = append(ids, id)
+	}
+	return ids
 }
 
-// Incr refCount for the volume vol. Creates new entry if needed.
-func (r RefCountsMap) Incr(vol string) uint {
+// Incr refCount for the volume vol by recording containerID as a user of
+// it. Creates a new entry if needed. A containerID already holding the
+// volume is a no-op, so a double-mount from the same container is
+// idempotent.
+func (r *RefCountsMap) Incr(vol string, containerID string) uint {
 	// Locks the RefCountsMap
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
@@ -220,14 +303,15 @@ func (r RefCountsMap) Incr(vol string) uint {
 		rc = newRefCount()
 		r.refMap[vol] = rc
 	}
-	rc.count++
-	return rc.count
+	rc.containers[containerID] = struct{}{}
+	r.persist(vol, rc)
+	return rc.count()
 }
 
-// Decr recfcount for the volume vol and returns the new count
-// returns -1  for error (and resets count to 0)
-// also deletes the node from the map if refcount drops to 0
-func (r RefCountsMap) Decr(vol string) (uint, error) {
+// Decr refcount for the volume vol by forgetting containerID, and returns
+// the new count. Returns an error if vol has no refcount record at all.
+// Also deletes the node from the map if refcount drops to 0.
+func (r *RefCountsMap) Decr(vol string, containerID string) (uint, error) {
 	// Locks the RefCountsMap
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
@@ -237,29 +321,23 @@ func (r RefCountsMap) Decr(vol string) (uint, error) {
 		return 0, fmt.Errorf("Decr: Missing refcount. name=%s", vol)
 	}
 
-	if rc.count == 0 {
-		// we should NEVER get here. Even if Docker sends Unmount before Mount,
-		// it should be caught in previous check. So delete the entry (in case
-		// someone upstairs does 'recover', and panic.
-		delete(r.refMap, vol)
-		log.Warning("Decr: refcnt already 0 (rc.count=0), name=%s", vol)
-		return 0, nil
+	if _, held := rc.containers[containerID]; !held {
+		log.Warningf("Decr: containerID=%s is not a recorded user of volume=%s", containerID, vol)
 	}
+	delete(rc.containers, containerID)
 
-	rc.count--
-
-	if rc.count < 0 {
-		log.Warningf("Decr: Internal error, refcnt is negative. Trying to recover, deleting the counter - name=%s refcnt=%d", vol, rc.count)
-	}
-	// Deletes the refcount only if there are no references
-	if rc.count <= 0 {
+	// Deletes the refcount only if there are no references left
+	if rc.count() == 0 {
 		delete(r.refMap, vol)
+		r.forget(vol)
+	} else {
+		r.persist(vol, rc)
 	}
-	return rc.count, nil
+	return rc.count(), nil
 }
 
 // enumberates volumes and  builds RefCountsMap, then sync with mount info
-func (r RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver) error {
+func (r *RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver) error {
 	// we assume to  have empty refcounts. Let's enforce
 
 	r.mtx.Lock() // Lock the RefCountsMap to purge the refcounts
@@ -268,34 +346,29 @@ func (r RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver)
 	}
 	r.mtx.Unlock() // Unlock.
 
-	filters := filters.NewArgs()
-	filters.Add("status", "running")
-	filters.Add("status", "paused")
-	filters.Add("status", "restarting")
+	runArgs := filters.NewArgs()
+	runArgs.Add("status", "running")
+	runArgs.Add("status", "paused")
+	runArgs.Add("status", "restarting")
 	containers, err := c.ContainerList(context.Background(), types.ContainerListOptions{
 		All:    true,
-		Filter: filters,
+		Filter: runArgs,
 	})
 	if err != nil {
 		return err
 	}
 
+	// Docker's live-restore feature can bring dockerd back up without
+	// restarting containers at all, but those containers are still
+	// "running" the whole time - the filter above already finds them, so
+	// there is no separate live-restore pass. Exited/created containers are
+	// deliberately NOT seeded here: their volumes aren't in /proc/mounts, so
+	// syncMountsWithRefCounters below would recovery-mount a volume for a
+	// container that will never issue the Unmount (or future die event)
+	// needed to release it again.
 	log.Debugf("Found %d running or paused containers", len(containers))
 	for _, ct := range containers {
-		containerJSONInfo, err := c.ContainerInspect(context.Background(), ct.ID)
-		if err != nil {
-			log.Errorf("ContainerInspect failed for %s (err: %v)", ct.Names, err)
-			continue
-		}
-		log.Debugf("  Mounts for %v", ct.Names)
-
-		for _, mount := range containerJSONInfo.Mounts {
-			if mount.Driver == driverName {
-				r.Incr(mount.Name)
-				log.Debugf("  name=%v (driver=%s source=%s) (%v)",
-					mount.Name, mount.Driver, mount.Source, mount)
-			}
-		}
+		r.seedFromContainer(c, ct.ID)
 	}
 
 	// Check that refcounts and actual mount info from Linux match
@@ -303,28 +376,89 @@ func (r RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver)
 	// not mounted but should be (it's error. we should not get there)
 
 	r.getMountInfo()
-	r.syncMountsWithRefCounters(d)
+	r.syncMountsWithRefCounters(c, d)
 
 	return nil
 }
 
-// syncronize mount info with refcounts - and unmounts if needed
-func (r RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
-	// Lock the RefCountsMap
-	r.mtx.Lock()
-	defer r.mtx.Unlock()
+// seedFromContainer inspects containerID and Incr's the refcount (by
+// containerID) of every volume it holds that belongs to our driver, and
+// records that mount's driver name on the volume's refCount.
+func (r *RefCountsMap) seedFromContainer(c *client.Client, containerID string) {
+	containerJSONInfo, err := c.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		log.Errorf("ContainerInspect failed for %s (err: %v)", containerID, err)
+		return
+	}
+	log.Debugf("  Mounts for %v", containerJSONInfo.Name)
+
+	for _, mount := range containerJSONInfo.Mounts {
+		if r.ownsDriver(mount.Driver) {
+			r.Incr(mount.Name, containerID)
+			r.mtx.Lock()
+			if rc := r.refMap[mount.Name]; rc != nil {
+				rc.driver = mount.Driver
+			}
+			r.mtx.Unlock()
+			log.Debugf("  name=%v (driver=%s source=%s) (%v)",
+				mount.Name, mount.Driver, mount.Source, mount)
+		}
+	}
+}
+
+// ownsDriver reports whether name is one of the drivers registered with
+// Init via DriverRoot.
+func (r *RefCountsMap) ownsDriver(name string) bool {
+	for _, root := range r.roots {
+		if root.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rootFor returns the DriverRoot whose MountRoot matches dir, if any.
+func (r *RefCountsMap) rootFor(dir string) (DriverRoot, bool) {
+	for _, root := range r.roots {
+		if root.MountRoot == dir {
+			return root, true
+		}
+	}
+	return DriverRoot{}, false
+}
 
+// copySeed names a just-recovery-mounted volume whose image content still
+// needs to be copied in, deferred until after syncMountsWithRefCounters has
+// released the RefCountsMap lock.
+type copySeed struct {
+	status     map[string]interface{}
+	vol        string
+	holder     string
+	mountpoint string
+}
+
+// syncronize mount info with refcounts - and unmounts if needed. c is used
+// only for the copy-on-first-mount check below, to look up the destination
+// path of a volume being recovery-mounted. The actual copy (CopyImageContentIfEmpty
+// shells out to `cp -a`, which can run for as long as the volume's image
+// content takes to copy) is deferred until after the RefCountsMap lock is
+// released, so a large copy doesn't stall every other Mount/Unmount/event
+// while it runs.
+func (r *RefCountsMap) syncMountsWithRefCounters(c *client.Client, d drivers.VolumeDriver) {
+	var seeds []copySeed
+
+	r.mtx.Lock()
 	for vol, cnt := range r.refMap {
 		f := log.Fields{
 			"name":    vol,
-			"refcnt":  cnt.count,
+			"refcnt":  cnt.count(),
 			"mounted": cnt.mounted,
 			"dev":     cnt.dev,
 		}
 
 		log.WithFields(f).Debug("Refcnt record: ")
 		if cnt.mounted == true {
-			if cnt.count == 0 {
+			if cnt.count() == 0 {
 				// Volume mounted but not used - UNMOUNT and DETACH !
 				log.WithFields(f).Info("Initiating recovery unmount. ")
 				err := d.UnmountVolume(vol)
@@ -333,7 +467,7 @@ func (r RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 				}
 			}
 		} else {
-			if cnt.count == 0 {
+			if cnt.count() == 0 {
 				// volume unmounted AND refcount 0.  We should NEVER get here
 				// since unmounted and recount==0 volumes should have no record
 				// in the map. Something went seriously wrong in the code.
@@ -351,7 +485,7 @@ func (r RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 					//Ensure the refcount map has this disk ID
 					id := ""
 					exists := false
-					if driverName == photonDriver {
+					if cnt.driver == PhotonDriver {
 						if id, exists = status["ID"].(string); !exists {
 							log.Warning("Failed to disk ID for photon disk cannot mount in use disk")
 						}
@@ -363,18 +497,25 @@ func (r RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 							isReadOnly = true
 						}
 					}
-					_, err = d.MountVolume(vol, status["fstype"].(string), id, isReadOnly, false)
+					mountpoint, err := d.MountVolume(vol, status["fstype"].(string), id, isReadOnly, false)
 					if err != nil {
 						log.Warning("Failed to mount - manual recovery may be needed")
+					} else if holder, ok := anyContainer(cnt); ok {
+						seeds = append(seeds, copySeed{status: status, vol: vol, holder: holder, mountpoint: mountpoint})
 					}
 				}
 			}
 		}
 	}
+	r.mtx.Unlock()
+
+	for _, s := range seeds {
+		CopyImageContentIfEmpty(c, s.status, s.vol, s.holder, s.mountpoint)
+	}
 }
 
 // scans /proc/mounts and updates refcount map witn mounted volumes
-func (r RefCountsMap) getMountInfo() error {
+func (r *RefCountsMap) getMountInfo() error {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 
@@ -390,7 +531,8 @@ func (r RefCountsMap) getMountInfo() error {
 			continue // skip empty line and lines too short to have our mount
 		}
 		// fields format: [/dev/sdb /mnt/vmdk/vol1 ext2 rw,relatime 0 0]
-		if filepath.Dir(field[1]) != mountRoot {
+		root, ok := r.rootFor(filepath.Dir(field[1]))
+		if !ok {
 			continue
 		}
 		volName := filepath.Base(field[1])
@@ -400,6 +542,7 @@ func (r RefCountsMap) getMountInfo() error {
 		}
 		refInfo.mounted = true
 		refInfo.dev = field[0]
+		refInfo.driver = root.Name
 		r.refMap[volName] = refInfo
 		log.Debugf("Found '%s' in /proc/mount, ref=(%#v)", volName, refInfo)
 	}
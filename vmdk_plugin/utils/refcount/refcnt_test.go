@@ -0,0 +1,135 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package refcount
+
+import (
+	"sort"
+	"sync"
+	"testing"
+)
+
+func newTestRefCountsMap() *RefCountsMap {
+	return &RefCountsMap{
+		refMap: make(map[string]*refCount),
+		mtx:    &sync.RWMutex{},
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	cases := []struct {
+		name      string
+		ops       func(r *RefCountsMap) (uint, error)
+		wantCount uint
+		wantErr   bool
+	}{
+		{
+			name: "first Incr for a volume returns 1",
+			ops: func(r *RefCountsMap) (uint, error) {
+				return r.Incr("vol1", "containerA"), nil
+			},
+			wantCount: 1,
+		},
+		{
+			name: "a second container Incr-ing the same volume returns 2",
+			ops: func(r *RefCountsMap) (uint, error) {
+				r.Incr("vol1", "containerA")
+				return r.Incr("vol1", "containerB"), nil
+			},
+			wantCount: 2,
+		},
+		{
+			name: "a double Incr from the same container is idempotent",
+			ops: func(r *RefCountsMap) (uint, error) {
+				r.Incr("vol1", "containerA")
+				return r.Incr("vol1", "containerA"), nil
+			},
+			wantCount: 1,
+		},
+		{
+			name: "Decr of the only holder drops the count to 0",
+			ops: func(r *RefCountsMap) (uint, error) {
+				r.Incr("vol1", "containerA")
+				return r.Decr("vol1", "containerA")
+			},
+			wantCount: 0,
+		},
+		{
+			name: "Decr of an unheld container ID on a tracked volume does not error",
+			ops: func(r *RefCountsMap) (uint, error) {
+				r.Incr("vol1", "containerA")
+				return r.Decr("vol1", "containerB")
+			},
+			wantCount: 1,
+		},
+		{
+			name: "Decr of a volume with no refcount record errors",
+			ops: func(r *RefCountsMap) (uint, error) {
+				return r.Decr("vol1", "containerA")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRefCountsMap()
+			count, err := tc.ops(r)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("got err=%v, wantErr=%t", err, tc.wantErr)
+			}
+			if count != tc.wantCount {
+				t.Fatalf("got count=%d, want %d", count, tc.wantCount)
+			}
+		})
+	}
+}
+
+func TestDecrToZeroRemovesTheEntry(t *testing.T) {
+	r := newTestRefCountsMap()
+	r.Incr("vol1", "containerA")
+	if _, err := r.Decr("vol1", "containerA"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := r.Decr("vol1", "containerA"); err == nil {
+		t.Fatal("expected an error decrementing a volume with no remaining refcount record")
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	r := newTestRefCountsMap()
+
+	if users := r.GetUsers("vol1"); len(users) != 0 {
+		t.Fatalf("expected no users for an untracked volume, got %v", users)
+	}
+
+	r.Incr("vol1", "containerA")
+	r.Incr("vol1", "containerB")
+
+	users := r.GetUsers("vol1")
+	sort.Strings(users)
+	want := []string{"containerA", "containerB"}
+	if len(users) != len(want) || users[0] != want[0] || users[1] != want[1] {
+		t.Fatalf("got users=%v, want %v", users, want)
+	}
+
+	r.Decr("vol1", "containerA")
+	users = r.GetUsers("vol1")
+	if len(users) != 1 || users[0] != "containerB" {
+		t.Fatalf("got users=%v, want [containerB]", users)
+	}
+}